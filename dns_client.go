@@ -1,11 +1,17 @@
 package secureoperator
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,6 +19,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
 )
 
 // ErrInvalidEndpointString is returned when an endpoint string is in an
@@ -31,11 +38,48 @@ var ErrFailedParsingPort = errors.New("unable to parse port from string")
 // servers
 var ErrAllServersFailed = errors.New("unable to reach any of the configured servers")
 
+// ErrNXDomain is returned by LookupIP when an authoritative NXDOMAIN
+// response shows the requested name does not exist. The negative result is
+// cached, so subsequent lookups keep returning ErrNXDomain until the
+// negative-cache TTL expires.
+var ErrNXDomain = errors.New("name does not exist")
+
+// ErrNoData is returned by LookupIP when an authoritative NOERROR response
+// has no answers of the queried type (e.g. an AAAA query against an
+// IPv4-only host). Like ErrNXDomain, this is cached per RFC 2308.
+var ErrNoData = errors.New("no data of the requested type")
+
+// ErrNoAnswer is returned by LookupIP when a NOERROR response has no answers
+// and no SOA record to negative-cache against, so it can't be told apart from
+// ErrNXDomain/ErrNoData or given a trustworthy TTL. It is not cached.
+var ErrNoAnswer = errors.New("no answer in response")
+
 // exchange is locally set to allow its mocking during testing
 var exchange = dns.ExchangeContext
 
+// tcpExchange is locally set to allow its mocking during testing. It's used
+// both by tcpUpstream and by udpUpstream's retry-on-truncation path.
+var tcpExchange = func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error) {
+	client := &dns.Client{Net: "tcp"}
+	r, _, err := client.ExchangeContext(ctx, msg, address)
+	return r, err
+}
+
 const defaultDNSClientTimeout = 10 * time.Second
 
+// defaultMaxNegativeTTL caps how long a negative (NXDOMAIN/NODATA) response
+// is cached when DNSClientOptions.MaxNegativeTTL is unset.
+const defaultMaxNegativeTTL = 5 * time.Minute
+
+// defaultHedgeDelay is how long the Racing strategy waits for an earlier
+// server to answer before starting the next one, when
+// DNSClientOptions.HedgeDelay is unset.
+const defaultHedgeDelay = 150 * time.Millisecond
+
+// healthEWMAAlpha weights how heavily the most recent latency sample counts
+// toward a server's running EWMA latency.
+const healthEWMAAlpha = 0.3
+
 // ParseEndpoint parses a string into an Endpoint object, where the endpoint
 // string is in the format of "ip:port". If a port is not present in the string,
 // the defaultPort is used.
@@ -66,7 +110,11 @@ func ParseEndpoint(endpoint string, defaultPort uint16) (ep Endpoint, err error)
 	return ep, err
 }
 
-// Endpoint represents a host/port combo
+// Endpoint represents a host/port combo.
+//
+// Deprecated: Endpoint only describes a plain-UDP server. Use ParseUpstream
+// and the Upstream interface instead, which also cover TCP, DNS-over-TLS,
+// and DNS-over-HTTPS.
 type Endpoint struct {
 	IP   net.IP
 	Port uint16
@@ -76,18 +124,452 @@ func (e Endpoint) String() string {
 	return net.JoinHostPort(e.IP.String(), fmt.Sprintf("%v", e.Port))
 }
 
-// Endpoints is a list of Endpoint objects
+// Endpoints is a list of Endpoint objects.
+//
+// Deprecated: see Endpoint.
 type Endpoints []Endpoint
 
-// Random retrieves a random Endpoint from a list of Endpoints
+// Random retrieves a random Endpoint from a list of Endpoints. It picks
+// uniformly; SimpleDNSClient itself no longer uses this for server
+// selection, preferring a health-weighted pick, but it's kept for callers
+// that just want any configured endpoint.
+//
+// Deprecated: see Endpoint.
 func (e Endpoints) Random() Endpoint {
 	return e[rand.Intn(len(e))]
 }
 
+// Upstream represents a single configured DNS resolver, reachable over some
+// transport. SimpleDNSClient queries a list of Upstreams rather than
+// talking to a transport directly, so plain UDP, TCP, DNS-over-TLS, and
+// DNS-over-HTTPS servers can all be mixed in the same client.
+type Upstream interface {
+	// Exchange sends msg to this upstream and returns its response.
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+
+	// Address returns a human-readable identifier for this upstream, used
+	// for logging and as its health-tracking key.
+	Address() string
+}
+
+// udpUpstream speaks plain UDP DNS to a single server, matching
+// SimpleDNSClient's original transport. A response with the truncated (TC)
+// bit set is automatically retried over TCP.
+type udpUpstream struct {
+	endpoint Endpoint
+}
+
+func newUDPUpstream(endpoint Endpoint) *udpUpstream {
+	return &udpUpstream{endpoint: endpoint}
+}
+
+func (u *udpUpstream) Address() string {
+	return u.endpoint.String()
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	r, err := exchange(ctx, msg, u.endpoint.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Truncated {
+		log.Debugf("udp response from %v truncated; retrying over tcp", u.endpoint)
+		return tcpExchange(ctx, msg, u.endpoint.String())
+	}
+
+	return r, nil
+}
+
+// tcpUpstream speaks DNS over plain TCP to a single server.
+type tcpUpstream struct {
+	endpoint Endpoint
+}
+
+func newTCPUpstream(endpoint Endpoint) *tcpUpstream {
+	return &tcpUpstream{endpoint: endpoint}
+}
+
+func (u *tcpUpstream) Address() string {
+	return "tcp://" + u.endpoint.String()
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	return tcpExchange(ctx, msg, u.endpoint.String())
+}
+
+// dotUpstream speaks DNS-over-TLS (RFC 7858) to a single server.
+type dotUpstream struct {
+	endpoint  Endpoint
+	tlsConfig *tls.Config
+}
+
+func newDoTUpstream(endpoint Endpoint, tlsConfig *tls.Config) *dotUpstream {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: endpoint.IP.String()}
+	}
+
+	return &dotUpstream{endpoint: endpoint, tlsConfig: tlsConfig}
+}
+
+func (u *dotUpstream) Address() string {
+	return "tls://" + u.endpoint.String()
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: u.tlsConfig}
+	r, _, err := client.ExchangeContext(ctx, msg, u.endpoint.String())
+	return r, err
+}
+
+// dohUpstream speaks DNS-over-HTTPS (RFC 8484) to a single server, POSTing
+// the wire-format query as application/dns-message.
+type dohUpstream struct {
+	url        string
+	httpClient *http.Client
+}
+
+func newDoHUpstream(url string) *dohUpstream {
+	// no client-side Timeout: Exchange's ctx (built from queryServer's
+	// per-query timeout, the same as every other transport) already bounds
+	// the request via http.NewRequestWithContext, so a second fixed timeout
+	// here would just race it and win with whichever is shorter.
+	return &dohUpstream{url: url, httpClient: &http.Client{}}
+}
+
+func (u *dohUpstream) Address() string {
+	return u.url
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh query to %v failed: %v", u.url, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &dns.Msg{}
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ParseUpstream parses an endpoint string into an Upstream, dispatching on
+// its URI scheme: "udp://" for plain UDP, "tcp://" for TCP-only, "tls://"
+// for DNS-over-TLS, and "https://" for DNS-over-HTTPS. A string with no
+// scheme is treated as plain UDP, for backward compatibility with
+// ParseEndpoint. The udp/tcp/tls host must be a literal IP; to configure one
+// of those by hostname, use ParseUpstreamWithBootstrap instead.
+func ParseUpstream(upstream string, defaultPort uint16) (Upstream, error) {
+	return ParseUpstreamWithBootstrap(upstream, defaultPort, nil)
+}
+
+// ParseUpstreamWithBootstrap is ParseUpstream, but additionally accepts a
+// hostname (e.g. "tls://dns.google:853") for the udp/tcp/tls schemes. The
+// hostname is resolved lazily, via bootstrap, on the upstream's first
+// Exchange, and the resolved address is cached for the TTL bootstrap
+// reports for it. If bootstrap is nil, hostnames are rejected just like in
+// ParseUpstream. https:// upstreams are resolved by the http.Client's own
+// DNS lookups and never need bootstrap.
+func ParseUpstreamWithBootstrap(upstream string, defaultPort uint16, bootstrap BootstrapResolver) (Upstream, error) {
+	scheme, rest, ok := strings.Cut(upstream, "://")
+	if !ok {
+		return parseHostUpstream(upstream, defaultPort, bootstrap, buildUDPUpstream)
+	}
+
+	switch scheme {
+	case "udp":
+		return parseHostUpstream(rest, defaultPort, bootstrap, buildUDPUpstream)
+
+	case "tcp":
+		return parseHostUpstream(rest, defaultPort, bootstrap, buildTCPUpstream)
+
+	case "tls":
+		return parseHostUpstream(rest, 853, bootstrap, buildDoTUpstream)
+
+	case "https":
+		return newDoHUpstream(upstream), nil
+
+	default:
+		return nil, ErrInvalidEndpointString
+	}
+}
+
+// build funcs receive both the endpoint (holding the resolved literal IP)
+// and the original host string as written in the upstream string (which,
+// for a bootstrapped upstream, is a hostname rather than ep.IP's address).
+// DoT needs the latter for TLS certificate validation; UDP/TCP ignore it.
+func buildUDPUpstream(ep Endpoint, _ string) Upstream { return newUDPUpstream(ep) }
+func buildTCPUpstream(ep Endpoint, _ string) Upstream { return newTCPUpstream(ep) }
+func buildDoTUpstream(ep Endpoint, host string) Upstream {
+	return newDoTUpstream(ep, &tls.Config{ServerName: host})
+}
+
+// parseHostUpstream splits s into a host and port, building an Upstream via
+// build directly if host is a literal IP. If host is a hostname, bootstrap
+// is used to resolve it lazily; if bootstrap is nil, the hostname is
+// rejected with ErrFailedParsingIP, matching ParseEndpoint's contract.
+func parseHostUpstream(s string, defaultPort uint16, bootstrap BootstrapResolver, build func(Endpoint, string) Upstream) (Upstream, error) {
+	host, port, err := splitHostPort(s, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return build(Endpoint{IP: ip, Port: port}, host), nil
+	}
+
+	if bootstrap == nil {
+		return nil, ErrFailedParsingIP
+	}
+
+	return &bootstrappedUpstream{host: host, port: port, bootstrap: bootstrap, build: build}, nil
+}
+
+// splitHostPort parses a "host[:port]" string, like ParseEndpoint, but
+// without requiring host to be a literal IP.
+func splitHostPort(s string, defaultPort uint16) (host string, port uint16, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 2 {
+		return "", 0, ErrInvalidEndpointString
+	}
+
+	host = parts[0]
+	port = defaultPort
+
+	if len(parts) > 1 {
+		i, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return "", 0, ErrFailedParsingPort
+		}
+
+		port = uint16(i)
+	}
+
+	return host, port, nil
+}
+
+// defaultBootstrapCacheTTL is how long a bootstrappedUpstream keeps a
+// resolved address when the bootstrap lookup didn't report a usable TTL.
+const defaultBootstrapCacheTTL = 5 * time.Minute
+
+// BootstrapResolver resolves a hostname to a set of literal IPs, used to
+// bootstrap upstream DNS servers that are themselves configured by hostname
+// (e.g. "dns.google:853") rather than literal IP.
+type BootstrapResolver interface {
+	// ResolveBootstrap resolves host to its IPs, along with how long that
+	// answer remains valid.
+	ResolveBootstrap(ctx context.Context, host string) (ips []net.IP, ttl time.Duration, err error)
+}
+
+// NewBootstrapResolver builds a BootstrapResolver that resolves hostnames
+// by querying the given literal-IP servers (e.g. "1.1.1.1" or
+// "1.1.1.1:53"), parsed the same way as ParseEndpoint. This lets a
+// hostname-based upstream be bootstrapped from one or more servers that are
+// themselves reachable by IP.
+func NewBootstrapResolver(servers []string, defaultPort uint16) (BootstrapResolver, error) {
+	endpoints := make(Endpoints, len(servers))
+	for i, s := range servers {
+		ep, err := ParseEndpoint(s, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints[i] = ep
+	}
+
+	client, err := NewSimpleDNSClient(endpoints, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsClientBootstrapResolver{client: client}, nil
+}
+
+// dnsClientBootstrapResolver implements BootstrapResolver on top of a
+// SimpleDNSClient configured with literal-IP servers.
+type dnsClientBootstrapResolver struct {
+	client *SimpleDNSClient
+}
+
+func (r *dnsClientBootstrapResolver) ResolveBootstrap(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	ips, err := r.client.LookupIPContext(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ttl time.Duration
+	if rec, ok := r.client.cache.Get(cacheKey(host, dns.TypeA)); ok {
+		if d := time.Until(rec.freshExpires); d > 0 {
+			ttl = d
+		}
+	}
+
+	return ips, ttl, nil
+}
+
+// bootstrappedUpstream wraps an Upstream whose address is a hostname rather
+// than a literal IP. The hostname is resolved via bootstrap on first
+// Exchange, and the resolved Upstream is cached until the bootstrap TTL (or
+// defaultBootstrapCacheTTL, if none was reported) elapses.
+type bootstrappedUpstream struct {
+	host      string
+	port      uint16
+	bootstrap BootstrapResolver
+	build     func(Endpoint, string) Upstream
+
+	mu       sync.Mutex
+	resolved Upstream
+	expires  time.Time
+}
+
+func (u *bootstrappedUpstream) Address() string {
+	return net.JoinHostPort(u.host, fmt.Sprintf("%v", u.port))
+}
+
+func (u *bootstrappedUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	resolved, err := u.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return resolved.Exchange(ctx, msg)
+}
+
+func (u *bootstrappedUpstream) resolve(ctx context.Context) (Upstream, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.resolved != nil && time.Now().Before(u.expires) {
+		return u.resolved, nil
+	}
+
+	ips, ttl, err := u.bootstrap.ResolveBootstrap(ctx, u.host)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap resolution of %v failed: %w", u.host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("bootstrap resolution of %v returned no addresses", u.host)
+	}
+
+	if ttl <= 0 {
+		ttl = defaultBootstrapCacheTTL
+	}
+
+	// pass the original hostname through, not just the resolved IP, so e.g.
+	// DoT can validate the server's TLS certificate against the hostname
+	// callers actually configured
+	u.resolved = u.build(Endpoint{IP: ips[0], Port: u.port}, u.host)
+	u.expires = time.Now().Add(ttl)
+
+	return u.resolved, nil
+}
+
+// serverHealth tracks a single upstream server's recent performance: a
+// running EWMA of response latency, and a count of consecutive failures.
+// It's used to weight server selection toward healthy, low-latency
+// endpoints.
+type serverHealth struct {
+	mu               sync.Mutex
+	ewmaLatency      time.Duration
+	consecutiveFails int
+}
+
+func (h *serverHealth) recordSuccess(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.ewmaLatency == 0 {
+		h.ewmaLatency = latency
+	} else {
+		h.ewmaLatency = time.Duration(float64(h.ewmaLatency)*(1-healthEWMAAlpha) + float64(latency)*healthEWMAAlpha)
+	}
+	h.consecutiveFails = 0
+}
+
+func (h *serverHealth) recordFailure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.consecutiveFails++
+}
+
+// weight scores the server for weighted selection: lower latency and fewer
+// consecutive failures score higher. A server with no recorded latency yet
+// gets a neutral baseline so it still gets a chance to prove itself.
+func (h *serverHealth) weight() float64 {
+	h.mu.Lock()
+	latency, fails := h.ewmaLatency, h.consecutiveFails
+	h.mu.Unlock()
+
+	base := 1.0
+	if latency > 0 {
+		base = 1.0 / (float64(latency.Milliseconds()) + 1)
+	}
+
+	return base / math.Pow(2, float64(fails))
+}
+
 type dnsCacheRecord struct {
-	msg     *dns.Msg
-	ips     []net.IP
-	expires time.Time
+	msg *dns.Msg
+	ips []net.IP
+
+	// negErr is set for a negative-cache record (ErrNXDomain/ErrNoData):
+	// the error LookupIP should return to callers for as long as the
+	// record is servable.
+	negErr error
+
+	// freshExpires is when this record stops being servable without
+	// triggering a refresh. hardExpires is when it can no longer be served
+	// at all and a caller must block on a fresh lookup.
+	freshExpires time.Time
+	hardExpires  time.Time
+}
+
+// isFresh reports whether the record can be served without kicking off a
+// background refresh.
+func (r dnsCacheRecord) isFresh() bool {
+	return time.Now().Before(r.freshExpires)
+}
+
+// isExpired reports whether the record is past its hard expiry and can no
+// longer be served, even stale.
+func (r dnsCacheRecord) isExpired() bool {
+	return time.Now().After(r.hardExpires)
+}
+
+// needsRefreshAhead reports whether the record, while still fresh, has
+// entered the configured refresh-ahead window and should have a background
+// refresh kicked off for it.
+func (r dnsCacheRecord) needsRefreshAhead(ahead time.Duration) bool {
+	if ahead <= 0 {
+		return false
+	}
+
+	return time.Now().After(r.freshExpires.Add(-ahead))
 }
 
 func newDNSCache() *dnsCache {
@@ -122,24 +604,167 @@ func (d *dnsCache) Set(key string, rec dnsCacheRecord) {
 
 type DNSClientOptions struct {
 	Timeout time.Duration
+
+	// StaleTTL extends how long a cache record may be served after it has
+	// gone stale (past its fresh TTL). Within this window, LookupIP returns
+	// the last known good IPs immediately and refreshes the record in the
+	// background. A zero value disables stale-while-revalidate; once a
+	// record's fresh TTL elapses, callers block on a new lookup.
+	StaleTTL time.Duration
+
+	// RefreshAhead kicks off a background refresh this long before a cache
+	// record's fresh TTL expires, so frequently requested hosts are kept
+	// warm and rarely fall into the stale window at all. A zero value
+	// disables refresh-ahead.
+	RefreshAhead time.Duration
+
+	// IPPreference controls which record types LookupIP queries and how the
+	// returned IPs are ordered. The zero value, IPv4Only, preserves
+	// LookupIP's historical A-only behavior.
+	IPPreference IPPreference
+
+	// Strategy controls how the configured servers are queried. The zero
+	// value, Sequential, preserves LookupIP's historical one-at-a-time
+	// behavior.
+	Strategy Strategy
+
+	// HedgeDelay is how long the Racing strategy waits for an earlier
+	// server to answer before starting the next one. Defaults to
+	// defaultHedgeDelay when Strategy is Racing and this is unset.
+	HedgeDelay time.Duration
+
+	// MaxNegativeTTL caps how long a negative (NXDOMAIN/NODATA) response is
+	// cached, regardless of what the authoritative SOA reports. Defaults to
+	// defaultMaxNegativeTTL when unset.
+	MaxNegativeTTL time.Duration
+
+	// IPv6Timeout, when set, bounds AAAA queries separately from Timeout.
+	// This lets LookupIPContext fall back to A-only results quickly on
+	// networks where IPv6 connectivity is slow or black-holed, instead of
+	// waiting the full Timeout on every AAAA query. A zero value (the
+	// default) uses Timeout for AAAA queries too.
+	IPv6Timeout time.Duration
 }
 
-// NewSimpleDNSClient creates a SimpleDNSClient
+// Strategy selects how SimpleDNSClient queries its configured servers.
+type Strategy int
+
+const (
+	// Sequential tries servers one at a time, in health-weighted order,
+	// stopping at the first success. This is the zero value.
+	Sequential Strategy = iota
+
+	// Parallel fans a query out to every configured server at once and
+	// returns the first successful NOERROR response, canceling the rest.
+	Parallel
+
+	// Racing staggers queries across servers, RFC 8305 Happy-Eyeballs
+	// style: it starts with the first server in health-weighted random
+	// order and, if no answer
+	// arrives within HedgeDelay, starts the next one too, and so on,
+	// returning the first successful response and canceling the rest.
+	Racing
+)
+
+// IPPreference selects which DNS record types SimpleDNSClient.LookupIP
+// queries, and how the resulting addresses are ordered.
+type IPPreference int
+
+const (
+	// IPv4Only queries A records only. This is the zero value.
+	IPv4Only IPPreference = iota
+
+	// IPv6Only queries AAAA records only.
+	IPv6Only
+
+	// PreferIPv4 queries both A and AAAA records and sorts IPv4 addresses
+	// first.
+	PreferIPv4
+
+	// PreferIPv6 queries both A and AAAA records and sorts IPv6 addresses
+	// first.
+	PreferIPv6
+
+	// Dual queries both A and AAAA records without reordering them.
+	Dual
+)
+
+// queryTypes returns the DNS record types LookupIP should query for this
+// preference.
+func (p IPPreference) queryTypes() []uint16 {
+	switch p {
+	case IPv6Only:
+		return []uint16{dns.TypeAAAA}
+	case PreferIPv4, PreferIPv6, Dual:
+		return []uint16{dns.TypeA, dns.TypeAAAA}
+	default:
+		return []uint16{dns.TypeA}
+	}
+}
+
+// sortIPs orders ips according to pref, stably. IPv4Only, IPv6Only, and
+// Dual leave the order returned by the upstream queries untouched.
+func sortIPs(ips []net.IP, pref IPPreference) []net.IP {
+	switch pref {
+	case PreferIPv4:
+		sort.SliceStable(ips, func(i, j int) bool {
+			return ips[i].To4() != nil && ips[j].To4() == nil
+		})
+	case PreferIPv6:
+		sort.SliceStable(ips, func(i, j int) bool {
+			return ips[i].To4() == nil && ips[j].To4() != nil
+		})
+	}
+
+	return ips
+}
+
+// cacheKey builds the dnsCache key for a (host, qtype) pair, since A and
+// AAAA answers for the same host are cached and refreshed independently.
+func cacheKey(host string, qtype uint16) string {
+	return host + "|" + strconv.Itoa(int(qtype))
+}
+
+// NewSimpleDNSClient creates a SimpleDNSClient that speaks plain UDP to the
+// given servers.
+//
+// Deprecated: use NewSimpleDNSClientWithUpstreams, which also allows TCP,
+// DNS-over-TLS, and DNS-over-HTTPS upstreams via ParseUpstream.
 func NewSimpleDNSClient(servers Endpoints, opts *DNSClientOptions) (*SimpleDNSClient, error) {
 	if len(servers) < 1 {
 		return nil, fmt.Errorf("at least one endpoint server is required")
 	}
+
+	upstreams := make([]Upstream, len(servers))
+	for i, ep := range servers {
+		upstreams[i] = newUDPUpstream(ep)
+	}
+
+	return NewSimpleDNSClientWithUpstreams(upstreams, opts)
+}
+
+// NewSimpleDNSClientWithUpstreams creates a SimpleDNSClient that queries the
+// given Upstreams, as produced by ParseUpstream.
+func NewSimpleDNSClientWithUpstreams(upstreams []Upstream, opts *DNSClientOptions) (*SimpleDNSClient, error) {
+	if len(upstreams) < 1 {
+		return nil, fmt.Errorf("at least one upstream server is required")
+	}
 	if opts == nil {
 		opts = &DNSClientOptions{}
 	}
 	if opts.Timeout == 0 {
 		opts.Timeout = defaultDNSClientTimeout
 	}
+	if opts.MaxNegativeTTL == 0 {
+		opts.MaxNegativeTTL = defaultMaxNegativeTTL
+	}
 
 	return &SimpleDNSClient{
-		servers: servers,
-		cache:   newDNSCache(),
-		opts:    opts,
+		upstreams: upstreams,
+		cache:     newDNSCache(),
+		opts:      opts,
+		sf:        &singleflight.Group{},
+		health:    make(map[string]*serverHealth, len(upstreams)),
 	}, nil
 }
 
@@ -149,68 +774,538 @@ func NewSimpleDNSClient(servers Endpoints, opts *DNSClientOptions) (*SimpleDNSCl
 // It provides an in-memory cache, but was optimized to look up one address
 // at a time only.
 type SimpleDNSClient struct {
-	servers Endpoints
-	cache   *dnsCache
-	opts    *DNSClientOptions
+	upstreams []Upstream
+	cache     *dnsCache
+	opts      *DNSClientOptions
+
+	// sf coalesces concurrent lookups and background refreshes for the same
+	// host into a single outstanding upstream query.
+	sf *singleflight.Group
+
+	// health and healthMu track per-server EWMA latency and failure counts,
+	// used to weight server selection.
+	healthMu sync.Mutex
+	health   map[string]*serverHealth
+}
+
+// healthFor returns the serverHealth tracker for upstream, creating one on
+// first use.
+func (c *SimpleDNSClient) healthFor(upstream Upstream) *serverHealth {
+	key := upstream.Address()
+
+	c.healthMu.Lock()
+	defer c.healthMu.Unlock()
+
+	h, ok := c.health[key]
+	if !ok {
+		h = &serverHealth{}
+		c.health[key] = h
+	}
+
+	return h
+}
+
+// weightedOrder returns the configured upstreams in a randomized order that
+// favors healthy, low-latency servers without entirely ruling out
+// unhealthy ones, replacing the uniform randomness of Endpoints.Random for
+// server selection.
+func (c *SimpleDNSClient) weightedOrder() []Upstream {
+	remaining := append([]Upstream{}, c.upstreams...)
+	weights := make([]float64, len(remaining))
+	for i, s := range remaining {
+		weights[i] = c.healthFor(s).weight()
+	}
+
+	ordered := make([]Upstream, 0, len(remaining))
+	for len(remaining) > 0 {
+		var total float64
+		for _, w := range weights {
+			total += w
+		}
+
+		pick := rand.Float64() * total
+
+		idx := len(remaining) - 1
+		for i, acc := 0, 0.0; i < len(remaining); i++ {
+			acc += weights[i]
+			if pick <= acc {
+				idx = i
+				break
+			}
+		}
+
+		ordered = append(ordered, remaining[idx])
+		remaining = append(remaining[:idx], remaining[idx+1:]...)
+		weights = append(weights[:idx], weights[idx+1:]...)
+	}
+
+	return ordered
 }
 
 // LookupIP does a single lookup against the client's configured DNS servers,
-// returning a value from cache if its still valid. It looks at A records only.
+// returning a value from cache if its still valid. It is equivalent to
+// calling LookupIPContext with context.Background().
+//
+// If a cached record is stale but within DNSClientOptions.StaleTTL, the last
+// known good IPs are returned immediately while a refresh happens in the
+// background.
+//
+// A negative response is cached too, and returned as an error: ErrNXDomain
+// if the name doesn't exist, ErrNoData if it exists but has no record of
+// the queried type, or ErrNoAnswer if neither could be determined.
 func (c *SimpleDNSClient) LookupIP(host string) ([]net.IP, error) {
-	// see if cache has the entry; if it's still good, return it
-	entry, ok := c.cache.Get(host)
-	if ok && entry.expires.After(time.Now()) {
-		log.Debugf("simple dns cache hit for %v", host)
-		return entry.ips, nil
+	return c.LookupIPContext(context.Background(), host)
+}
+
+// LookupIPContext does a single lookup against the client's configured DNS
+// servers, returning a value from cache if its still valid. The record
+// types queried (A and/or AAAA) are governed by DNSClientOptions.IPPreference,
+// and the returned IPs are ordered per that same preference. Unlike
+// LookupIP, ctx bounds how long this call waits for the underlying queries;
+// those queries are shared with other callers of the same host and keep
+// running after ctx is canceled. If the
+// caller cancels ctx before every queried record type has answered, results
+// already gathered are still returned alongside the cancellation error. If
+// ctx itself is not canceled but an individual record type's query still
+// failed or timed out on its own (e.g. an AAAA query hitting
+// DNSClientOptions.IPv6Timeout), that's treated as a transparent fallback:
+// any other record type's results are returned with no error, same as
+// LookupIP's historical A-only behavior.
+func (c *SimpleDNSClient) LookupIPContext(ctx context.Context, host string) ([]net.IP, error) {
+	qtypes := c.opts.IPPreference.queryTypes()
+
+	type lookupResult struct {
+		ips []net.IP
+		err error
 	}
 
-	// we need to look it up
-	for _, server := range c.servers {
-		msg := dns.Msg{}
-		msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	results := make([]lookupResult, len(qtypes))
+
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
 
-		ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
-		defer cancel()
+			ips, err := c.lookupType(ctx, host, qtype)
+			results[i] = lookupResult{ips: ips, err: err}
+		}(i, qtype)
+	}
+	wg.Wait()
 
-		log.Infof("simple dns lookup %v", host)
-		r, err := exchange(ctx, &msg, server.String())
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-			// was a timeout error; continue to the next server
+	var merged []net.IP
+	var lastErr error
+
+	for _, res := range results {
+		if res.err != nil {
+			lastErr = res.err
 			continue
 		}
+
+		merged = append(merged, res.ips...)
+	}
+
+	// if the caller's own ctx was canceled or timed out, say so explicitly
+	// alongside whatever partial results we have, regardless of whether any
+	// came back; a caller that asked us to stop deserves to know we did.
+	if err := ctx.Err(); err != nil {
+		return sortIPs(merged, c.opts.IPPreference), err
+	}
+
+	// otherwise, an individual query type timing out or coming back empty
+	// (including an IPv6Timeout falling back to A-only) shouldn't poison
+	// otherwise-usable partial results: if at least one queried record type
+	// succeeded, return what we have and let the caller treat this as
+	// success, same as the historical A-only behavior.
+	if len(merged) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	return sortIPs(merged, c.opts.IPPreference), nil
+}
+
+// lookupType resolves host for a single qtype, consulting and populating
+// the cache, and coalescing concurrent callers via sf.
+func (c *SimpleDNSClient) lookupType(ctx context.Context, host string, qtype uint16) ([]net.IP, error) {
+	key := cacheKey(host, qtype)
+
+	// see if cache has the entry; if it's still good (or stale-but-usable),
+	// return it
+	rec, ok := c.cache.Get(key)
+	if ok && !rec.isExpired() {
+		if !rec.isFresh() {
+			log.Debugf("simple dns cache stale hit for %v; refreshing in background", key)
+			c.refreshInBackground(host, qtype)
+		} else if rec.needsRefreshAhead(c.opts.RefreshAhead) {
+			log.Debugf("simple dns cache refresh-ahead for %v", key)
+			c.refreshInBackground(host, qtype)
+		} else {
+			log.Debugf("simple dns cache hit for %v", key)
+		}
+
+		if rec.negErr != nil {
+			return nil, rec.negErr
+		}
+
+		return rec.ips, nil
+	}
+
+	// the lookup itself runs detached from any individual caller's ctx, on
+	// context.Background() (same as refreshInBackground), so one waiter's
+	// cancellation or deadline can't cut the shared, singleflight-coalesced
+	// query short for every other caller waiting on the same key. Each
+	// waiter still applies its own ctx below, but only to how long it is
+	// willing to wait for that shared result.
+	ch := c.sf.DoChan(key, func() (interface{}, error) {
+		return c.lookupAndCache(context.Background(), host, qtype)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+
+		return res.Val.([]net.IP), nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// isNegativeCacheError reports whether err is one of the negative-cache
+// sentinels (ErrNXDomain, ErrNoData, ErrNoAnswer), which represent a valid
+// authoritative answer rather than a failure to reach a server.
+func isNegativeCacheError(err error) bool {
+	return errors.Is(err, ErrNXDomain) || errors.Is(err, ErrNoData) || errors.Is(err, ErrNoAnswer)
+}
+
+// refreshInBackground kicks off an async lookup for (host, qtype), coalesced
+// through sf so it joins any lookup already in flight instead of issuing a
+// second upstream query.
+func (c *SimpleDNSClient) refreshInBackground(host string, qtype uint16) {
+	key := cacheKey(host, qtype)
+
+	go func() {
+		if _, err, _ := c.sf.Do(key, func() (interface{}, error) {
+			return c.lookupAndCache(context.Background(), host, qtype)
+		}); err != nil && !isNegativeCacheError(err) {
+			log.Debugf("background refresh of %v failed: %v", key, err)
+		}
+	}()
+}
+
+// lookupAndCache performs the actual upstream lookup of host for the given
+// qtype, using the client's configured Strategy to pick among its servers,
+// caches the result (positive or negative), and returns it. A negative
+// result (ErrNXDomain, ErrNoData) is returned as an error, same as any
+// other failure to produce IPs.
+func (c *SimpleDNSClient) lookupAndCache(ctx context.Context, host string, qtype uint16) ([]net.IP, error) {
+	var (
+		r   *dns.Msg
+		err error
+	)
+
+	switch c.opts.Strategy {
+	case Parallel:
+		r, err = c.queryParallel(ctx, host, qtype)
+	case Racing:
+		r, err = c.queryRacing(ctx, host, qtype)
+	default:
+		r, err = c.querySequential(ctx, host, qtype)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rec := recordFromAnswer(r, c.opts.MaxNegativeTTL)
+	if rec.negErr == ErrNoAnswer {
+		// uncacheable: freshExpires is already time.Now(), and it must stay
+		// that way rather than gaining a StaleTTL window, or lookupType
+		// would keep serving this guess as if it were stale-but-valid for
+		// the rest of StaleTTL instead of trying again immediately.
+		rec.hardExpires = rec.freshExpires
+	} else {
+		rec.hardExpires = rec.freshExpires.Add(c.opts.StaleTTL)
+	}
+	c.cache.Set(cacheKey(host, qtype), rec)
+
+	if rec.negErr != nil {
+		return nil, rec.negErr
+	}
+
+	return rec.ips, nil
+}
+
+// recordFromAnswer builds a dnsCacheRecord from a query response. Callers
+// still need to set hardExpires.
+//
+// If the response has no positive answers, it's negative-cached per RFC
+// 2308: an NXDOMAIN rcode sets negErr to ErrNXDomain, an empty NOERROR
+// answer accompanied by an SOA record (from which the negative TTL is
+// derived) sets it to ErrNoData, and an empty answer with no SOA to time-
+// bound it sets it to ErrNoAnswer and isn't meaningfully cached.
+func recordFromAnswer(r *dns.Msg, maxNegativeTTL time.Duration) dnsCacheRecord {
+	rec := dnsCacheRecord{msg: r}
+
+	var shortestTTL uint32
+
+	for _, ans := range r.Answer {
+		h := ans.Header()
+
+		var ip net.IP
+		switch t := ans.(type) {
+		case *dns.A:
+			ip = t.A
+		case *dns.AAAA:
+			ip = t.AAAA
+		default:
+			continue
+		}
+
+		rec.ips = append(rec.ips, ip)
+
+		// if the TTL of this record is the shortest or first seen, use it
+		// as the cache record TTL
+		if shortestTTL == 0 || h.Ttl < shortestTTL {
+			shortestTTL = h.Ttl
+		}
+	}
+
+	if len(rec.ips) > 0 {
+		rec.freshExpires = time.Now().Add(time.Second * time.Duration(shortestTTL))
+		return rec
+	}
+
+	// no positive answers: this is a negative response, or one we can't
+	// time-bound at all
+	negTTL, hasSOA := negativeTTLFromSOA(r, maxNegativeTTL)
+
+	switch {
+	case r.Rcode == dns.RcodeNameError:
+		rec.negErr = ErrNXDomain
+	case hasSOA:
+		rec.negErr = ErrNoData
+	default:
+		rec.negErr = ErrNoAnswer
+	}
+
+	if hasSOA {
+		rec.freshExpires = time.Now().Add(negTTL)
+	} else {
+		// nothing to cache this against; expire immediately so the next
+		// lookup tries again rather than being stuck on a guess
+		rec.freshExpires = time.Now()
+	}
+
+	return rec
+}
+
+// negativeTTLFromSOA looks for a SOA record in r.Ns and returns the RFC
+// 2308 negative-caching TTL derived from it — the minimum of the SOA
+// record's own TTL and its MINIMUM field — capped at maxNegativeTTL.
+func negativeTTLFromSOA(r *dns.Msg, maxNegativeTTL time.Duration) (time.Duration, bool) {
+	for _, rr := range r.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+
+		negTTL := time.Second * time.Duration(ttl)
+		if maxNegativeTTL > 0 && negTTL > maxNegativeTTL {
+			negTTL = maxNegativeTTL
+		}
+
+		return negTTL, true
+	}
+
+	return 0, false
+}
+
+// isSoftFailureRcode reports whether rcode represents a resolver-level
+// failure (e.g. SERVFAIL, REFUSED) that should advance to the next server,
+// as opposed to an authoritative answer like NOERROR or NXDOMAIN.
+func isSoftFailureRcode(rcode int) bool {
+	switch rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return false
+	default:
+		return true
+	}
+}
+
+// errAllServersFailed wraps ErrAllServersFailed together with the
+// individual per-server errors via errors.Join, so callers can both match
+// on errors.Is(err, ErrAllServersFailed) and inspect what each server said.
+func errAllServersFailed(errs []error) error {
+	return errors.Join(append([]error{ErrAllServersFailed}, errs...)...)
+}
+
+// queryServer issues a single DNS query for (host, qtype) against upstream,
+// recording the outcome into that upstream's health. A response with a soft
+// failure rcode (SERVFAIL, REFUSED, ...) is treated as an error so callers
+// advance to the next server instead of caching it.
+func (c *SimpleDNSClient) queryServer(ctx context.Context, upstream Upstream, host string, qtype uint16) (*dns.Msg, error) {
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+
+	qctx, cancel := context.WithTimeout(ctx, c.timeoutFor(qtype))
+	defer cancel()
+
+	log.Infof("simple dns lookup %v (%v) via %v", host, dns.TypeToString[qtype], upstream.Address())
+	start := time.Now()
+	r, err := upstream.Exchange(qctx, &msg)
+	latency := time.Since(start)
+
+	h := c.healthFor(upstream)
+
+	if err != nil {
+		h.recordFailure()
+		return nil, fmt.Errorf("%v: %w", upstream.Address(), err)
+	}
+
+	if isSoftFailureRcode(r.Rcode) {
+		h.recordFailure()
+		return nil, fmt.Errorf("%v: rcode %v", upstream.Address(), dns.RcodeToString[r.Rcode])
+	}
+
+	h.recordSuccess(latency)
+
+	return r, nil
+}
+
+// timeoutFor returns the per-query timeout for qtype: IPv6Timeout for AAAA
+// queries when set, otherwise the client's default Timeout.
+func (c *SimpleDNSClient) timeoutFor(qtype uint16) time.Duration {
+	if qtype == dns.TypeAAAA && c.opts.IPv6Timeout > 0 {
+		return c.opts.IPv6Timeout
+	}
+
+	return c.opts.Timeout
+}
+
+// querySequential tries the configured servers one at a time, in
+// health-weighted order, returning the first success.
+func (c *SimpleDNSClient) querySequential(ctx context.Context, host string, qtype uint16) (*dns.Msg, error) {
+	var errs []error
+
+	for _, server := range c.weightedOrder() {
+		r, err := c.queryServer(ctx, server, host, qtype)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
 
-		rec := dnsCacheRecord{
-			msg: r,
+		return r, nil
+	}
+
+	return nil, errAllServersFailed(errs)
+}
+
+// serverQueryResult carries the outcome of a single server's query back to
+// the strategy coordinating goroutine.
+type serverQueryResult struct {
+	msg *dns.Msg
+	err error
+}
+
+// queryParallel fans the query out to every configured server at once and
+// returns the first successful NOERROR response, canceling the rest.
+func (c *SimpleDNSClient) queryParallel(ctx context.Context, host string, qtype uint16) (*dns.Msg, error) {
+	servers := c.weightedOrder()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan serverQueryResult, len(servers))
+	for _, server := range servers {
+		server := server
+		go func() {
+			msg, err := c.queryServer(ctx, server, host, qtype)
+			results <- serverQueryResult{msg: msg, err: err}
+		}()
+	}
+
+	var errs []error
+	for i := 0; i < len(servers); i++ {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
 		}
 
-		var shortestTTL uint32
+		cancel()
+		return res.msg, nil
+	}
 
-		for _, ans := range r.Answer {
-			h := ans.Header()
+	return nil, errAllServersFailed(errs)
+}
 
-			if t, ok := ans.(*dns.A); ok {
-				rec.ips = append(rec.ips, t.A)
+// queryRacing staggers queries across the configured servers, RFC
+// 8305-style: it starts with the first server in health-weighted random
+// order (see weightedOrder) and, if no answer
+// arrives within HedgeDelay, starts the next one too, and so on, returning
+// the first successful response and canceling the rest.
+func (c *SimpleDNSClient) queryRacing(parentCtx context.Context, host string, qtype uint16) (*dns.Msg, error) {
+	servers := c.weightedOrder()
 
-				// if the TTL of this record is the shortest or first seen, use it
-				// as the cache record TTL
-				if shortestTTL == 0 || h.Ttl < shortestTTL {
-					shortestTTL = h.Ttl
+	hedgeDelay := c.opts.HedgeDelay
+	if hedgeDelay <= 0 {
+		hedgeDelay = defaultHedgeDelay
+	}
+
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	// results is sized so every goroutine below can always send its one
+	// outcome without blocking, even after cancel() fires early; that way
+	// the reader loop can still count on exactly len(servers) sends.
+	results := make(chan serverQueryResult, len(servers))
+	for i, server := range servers {
+		server := server
+		delay := time.Duration(i) * hedgeDelay
+
+		go func() {
+			if delay > 0 {
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+
+				select {
+				case <-ctx.Done():
+					results <- serverQueryResult{err: ctx.Err()}
+					return
+				case <-timer.C:
 				}
 			}
-		}
 
-		// set the expiry
-		rec.expires = time.Now().Add(time.Second * time.Duration(shortestTTL))
+			msg, err := c.queryServer(ctx, server, host, qtype)
+			results <- serverQueryResult{msg: msg, err: err}
+		}()
+	}
 
-		// cache the record
-		c.cache.Set(host, rec)
+	var errs []error
+	for i := 0; i < len(servers); i++ {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				errs = append(errs, res.err)
+				continue
+			}
 
-		return rec.ips, nil
+			cancel()
+			return res.msg, nil
+
+		case <-parentCtx.Done():
+			// the caller gave up; no point waiting on the stragglers, which
+			// will still each deliver into the buffered channel above
+			return nil, parentCtx.Err()
+		}
 	}
 
-	// we didn't reach any server; return a known error
-	return nil, ErrAllServersFailed
+	return nil, errAllServersFailed(errs)
 }
@@ -0,0 +1,69 @@
+package secureoperator
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseUpstreamWithBootstrap(t *testing.T) {
+	const bootstrapAddr = "9.9.9.9:53"
+	resolvedAddr := net.JoinHostPort("149.112.112.112", "53")
+
+	var bootstrapCalls, realCalls int32
+
+	mockExchange(t, func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error) {
+		switch address {
+		case bootstrapAddr:
+			atomic.AddInt32(&bootstrapCalls, 1)
+			return aResponse(msg.Question[0].Name, net.ParseIP("149.112.112.112"), 300), nil
+		case resolvedAddr:
+			atomic.AddInt32(&realCalls, 1)
+			return aResponse("example.com.", net.ParseIP("8.8.8.8"), 60), nil
+		default:
+			t.Fatalf("unexpected exchange address %v", address)
+			return nil, nil
+		}
+	})
+
+	bootstrap, err := NewBootstrapResolver([]string{"9.9.9.9"}, 53)
+	if err != nil {
+		t.Fatalf("NewBootstrapResolver: %v", err)
+	}
+
+	upstream, err := ParseUpstreamWithBootstrap("udp://dns.quad9.net:53", 53, bootstrap)
+	if err != nil {
+		t.Fatalf("ParseUpstreamWithBootstrap: %v", err)
+	}
+
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+
+	for i := 0; i < 2; i++ {
+		r, err := upstream.Exchange(context.Background(), &msg)
+		if err != nil {
+			t.Fatalf("Exchange #%d: %v", i, err)
+		}
+
+		a, ok := r.Answer[0].(*dns.A)
+		if len(r.Answer) != 1 || !ok || !a.A.Equal(net.ParseIP("8.8.8.8")) {
+			t.Fatalf("Exchange #%d: unexpected answer: %v", i, r.Answer)
+		}
+	}
+
+	if got := atomic.LoadInt32(&bootstrapCalls); got != 1 {
+		t.Fatalf("expected the bootstrap hostname to be resolved once and cached, got %d resolutions", got)
+	}
+	if got := atomic.LoadInt32(&realCalls); got != 2 {
+		t.Fatalf("expected 2 real queries against the resolved address, got %d", got)
+	}
+}
+
+func TestParseUpstreamWithBootstrapRejectsHostnameWithoutBootstrap(t *testing.T) {
+	if _, err := ParseUpstream("udp://dns.quad9.net:53", 53); err != ErrFailedParsingIP {
+		t.Fatalf("expected ErrFailedParsingIP for a hostname with no bootstrap resolver, got %v", err)
+	}
+}
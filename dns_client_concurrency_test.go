@@ -0,0 +1,82 @@
+package secureoperator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestQueryRacingDoesNotDeadlockOnCtxCancellation is a regression test for
+// the hang fixed in queryRacing: with HedgeDelay long enough that only the
+// first server's goroutine is actually querying, canceling the caller's ctx
+// used to leave the reader loop waiting forever for len(servers) sends that
+// would never all arrive.
+func TestQueryRacingDoesNotDeadlockOnCtxCancellation(t *testing.T) {
+	mockExchange(t, func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	c, err := NewSimpleDNSClient(Endpoints{
+		{IP: net.ParseIP("127.0.0.1"), Port: 53},
+		{IP: net.ParseIP("127.0.0.1"), Port: 54},
+		{IP: net.ParseIP("127.0.0.1"), Port: 55},
+	}, &DNSClientOptions{
+		Strategy:   Racing,
+		HedgeDelay: time.Hour, // never fires during this test
+	})
+	if err != nil {
+		t.Fatalf("NewSimpleDNSClient: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = c.queryRacing(ctx, "example.com", dns.TypeA)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("queryRacing deadlocked: it did not return after ctx cancellation")
+	}
+}
+
+// TestLookupIPParallelStrategyReturnsFirstSuccess exercises queryParallel's
+// health-weighted fan-out: one server fails immediately, the other
+// succeeds, and the client should return the success without surfacing the
+// other server's error.
+func TestLookupIPParallelStrategyReturnsFirstSuccess(t *testing.T) {
+	badAddr := net.JoinHostPort("127.0.0.1", "54")
+
+	mockExchange(t, func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error) {
+		if address == badAddr {
+			return nil, errors.New("connection refused")
+		}
+
+		return aResponse("example.com.", net.ParseIP("3.3.3.3"), 60), nil
+	})
+
+	c, err := NewSimpleDNSClient(Endpoints{
+		{IP: net.ParseIP("127.0.0.1"), Port: 53},
+		{IP: net.ParseIP("127.0.0.1"), Port: 54},
+	}, &DNSClientOptions{Strategy: Parallel})
+	if err != nil {
+		t.Fatalf("NewSimpleDNSClient: %v", err)
+	}
+
+	ips, err := c.LookupIP("example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("3.3.3.3")) {
+		t.Fatalf("unexpected result: %v", ips)
+	}
+}
@@ -0,0 +1,76 @@
+package secureoperator
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func soaRecord(ttl, minttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Minttl: minttl,
+	}
+}
+
+func TestRecordFromAnswerNXDomainWithSOA(t *testing.T) {
+	r := &dns.Msg{}
+	r.SetQuestion("nope.example.com.", dns.TypeA)
+	r.Rcode = dns.RcodeNameError
+	r.Ns = []dns.RR{soaRecord(3600, 300)}
+
+	rec := recordFromAnswer(r, 0)
+
+	if !errors.Is(rec.negErr, ErrNXDomain) {
+		t.Fatalf("expected ErrNXDomain, got %v", rec.negErr)
+	}
+	if d := time.Until(rec.freshExpires); d <= 0 || d > 300*time.Second {
+		t.Fatalf("expected freshExpires ~300s out (SOA Minttl), got %v", d)
+	}
+}
+
+func TestRecordFromAnswerNoDataWithSOA(t *testing.T) {
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeAAAA)
+	r.Rcode = dns.RcodeSuccess
+	r.Ns = []dns.RR{soaRecord(3600, 300)}
+
+	rec := recordFromAnswer(r, 0)
+
+	if !errors.Is(rec.negErr, ErrNoData) {
+		t.Fatalf("expected ErrNoData, got %v", rec.negErr)
+	}
+	if d := time.Until(rec.freshExpires); d <= 0 || d > 300*time.Second {
+		t.Fatalf("expected freshExpires ~300s out (SOA Minttl), got %v", d)
+	}
+}
+
+func TestRecordFromAnswerNoAnswerWithoutSOA(t *testing.T) {
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.Rcode = dns.RcodeSuccess
+
+	rec := recordFromAnswer(r, 0)
+
+	if !errors.Is(rec.negErr, ErrNoAnswer) {
+		t.Fatalf("expected ErrNoAnswer, got %v", rec.negErr)
+	}
+	if rec.freshExpires.After(time.Now().Add(time.Millisecond)) {
+		t.Fatalf("expected freshExpires to be uncacheable (~now), got %v in the future", time.Until(rec.freshExpires))
+	}
+}
+
+func TestRecordFromAnswerCapsNegativeTTL(t *testing.T) {
+	r := &dns.Msg{}
+	r.SetQuestion("example.com.", dns.TypeAAAA)
+	r.Rcode = dns.RcodeSuccess
+	r.Ns = []dns.RR{soaRecord(3600, 300)}
+
+	rec := recordFromAnswer(r, 60*time.Second)
+
+	if d := time.Until(rec.freshExpires); d <= 0 || d > 61*time.Second {
+		t.Fatalf("expected freshExpires capped to ~60s by MaxNegativeTTL, got %v", d)
+	}
+}
@@ -0,0 +1,159 @@
+package secureoperator
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mockExchange swaps the package-level exchange var for fn for the duration
+// of the test.
+func mockExchange(t *testing.T, fn func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error)) {
+	t.Helper()
+
+	orig := exchange
+	exchange = fn
+	t.Cleanup(func() { exchange = orig })
+}
+
+// aResponse builds a minimal NOERROR response carrying a single A record
+// for name.
+func aResponse(name string, ip net.IP, ttl uint32) *dns.Msg {
+	r := &dns.Msg{}
+	r.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	r.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   ip,
+	}}
+	return r
+}
+
+func newTestClient(t *testing.T, opts *DNSClientOptions) *SimpleDNSClient {
+	t.Helper()
+
+	c, err := NewSimpleDNSClient(Endpoints{{IP: net.ParseIP("127.0.0.1"), Port: 53}}, opts)
+	if err != nil {
+		t.Fatalf("NewSimpleDNSClient: %v", err)
+	}
+
+	return c
+}
+
+func TestLookupIPConcurrentCallersCoalesce(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+
+	mockExchange(t, func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return aResponse("example.com.", net.ParseIP("1.2.3.4"), 60), nil
+	})
+
+	c := newTestClient(t, nil)
+
+	const n = 10
+
+	var wg sync.WaitGroup
+	results := make([][]net.IP, n)
+	errsOut := make([]error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errsOut[i] = c.LookupIP("example.com")
+		}(i)
+	}
+
+	// give every goroutine a chance to reach the in-flight exchange call
+	// before letting it complete
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected a single coalesced exchange for %d concurrent callers, got %d", n, got)
+	}
+
+	for i, err := range errsOut {
+		if err != nil {
+			t.Fatalf("caller %d: unexpected error: %v", i, err)
+		}
+		if len(results[i]) != 1 || !results[i][0].Equal(net.ParseIP("1.2.3.4")) {
+			t.Fatalf("caller %d: unexpected result: %v", i, results[i])
+		}
+	}
+}
+
+func TestLookupIPRefreshAhead(t *testing.T) {
+	var calls int32
+
+	mockExchange(t, func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error) {
+		atomic.AddInt32(&calls, 1)
+		return aResponse("example.com.", net.ParseIP("1.2.3.4"), 60), nil
+	})
+
+	c := newTestClient(t, &DNSClientOptions{RefreshAhead: 2 * time.Second})
+
+	// seed the cache with a record that's fresh but inside the
+	// refresh-ahead window
+	c.cache.Set(cacheKey("example.com", dns.TypeA), dnsCacheRecord{
+		ips:          []net.IP{net.ParseIP("5.6.7.8")},
+		freshExpires: time.Now().Add(500 * time.Millisecond),
+		hardExpires:  time.Now().Add(time.Minute),
+	})
+
+	ips, err := c.LookupIP("example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("5.6.7.8")) {
+		t.Fatalf("expected the cached record to be served immediately, got %v", ips)
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Fatalf("expected no synchronous exchange, got %d", atomic.LoadInt32(&calls))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&calls) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&calls) == 0 {
+		t.Fatal("expected a background refresh-ahead exchange to have fired")
+	}
+}
+
+func TestLookupIPHardExpiryForcesFreshLookup(t *testing.T) {
+	var calls int32
+
+	mockExchange(t, func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error) {
+		atomic.AddInt32(&calls, 1)
+		return aResponse("example.com.", net.ParseIP("9.9.9.9"), 60), nil
+	})
+
+	c := newTestClient(t, &DNSClientOptions{StaleTTL: time.Minute})
+
+	// seed the cache with a record that's past even its hard expiry
+	c.cache.Set(cacheKey("example.com", dns.TypeA), dnsCacheRecord{
+		ips:          []net.IP{net.ParseIP("1.1.1.1")},
+		freshExpires: time.Now().Add(-time.Hour),
+		hardExpires:  time.Now().Add(-time.Minute),
+	})
+
+	ips, err := c.LookupIP("example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected a synchronous lookup for a hard-expired record, got %d calls", got)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("9.9.9.9")) {
+		t.Fatalf("expected the freshly looked-up IP, got %v", ips)
+	}
+}
@@ -0,0 +1,48 @@
+package secureoperator
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestUDPUpstreamRetriesOverTCPOnTruncation covers udpUpstream's
+// truncation-retry path: a truncated UDP response should trigger exactly
+// one retry over TCP, to the same address.
+func TestUDPUpstreamRetriesOverTCPOnTruncation(t *testing.T) {
+	addr := net.JoinHostPort("127.0.0.1", "53")
+
+	mockExchange(t, func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error) {
+		r := aResponse("example.com.", net.ParseIP("4.4.4.4"), 60)
+		r.Truncated = true
+		return r, nil
+	})
+
+	var tcpCalls int32
+	origTCP := tcpExchange
+	tcpExchange = func(ctx context.Context, msg *dns.Msg, address string) (*dns.Msg, error) {
+		atomic.AddInt32(&tcpCalls, 1)
+		if address != addr {
+			t.Fatalf("expected tcp retry to go to %v, got %v", addr, address)
+		}
+
+		return aResponse("example.com.", net.ParseIP("4.4.4.4"), 60), nil
+	}
+	t.Cleanup(func() { tcpExchange = origTCP })
+
+	up := newUDPUpstream(Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 53})
+
+	r, err := up.Exchange(context.Background(), &dns.Msg{})
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if got := atomic.LoadInt32(&tcpCalls); got != 1 {
+		t.Fatalf("expected exactly one tcp retry, got %d", got)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatalf("expected the tcp retry's answer to be returned, got %v", r.Answer)
+	}
+}